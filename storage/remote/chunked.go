@@ -14,24 +14,72 @@ package remote
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultChunkedReadLimit is the default value for the maximum size of a frame
+// read by the ChunkedReader. This is equivalent to 16 MiB which is the
+// default in Prometheus remote read and write requests.
+const DefaultChunkedReadLimit = 16 * 1024 * 1024
+
+// ErrFrameTooLarge is returned by ChunkedReader.Next when the declared size of
+// a frame exceeds the configured maxFrame limit. The offending payload is not
+// read from the underlying reader.
+var ErrFrameTooLarge = errors.New("chunked read: frame too large")
+
+// Codec identifies how a frame's payload is compressed. It is carried as a
+// single byte immediately preceding the payload when a ChunkedWriter/ChunkedReader
+// pair has negotiated per-frame compression; see NewChunkedWriterWithCodec.
+type Codec byte
+
+const (
+	// CodecNone indicates the payload is stored as-is, uncompressed.
+	CodecNone Codec = iota
+	// CodecSnappy indicates the payload is compressed with Snappy block compression.
+	CodecSnappy
+	// CodecGzip indicates the payload is compressed with gzip.
+	CodecGzip
 )
 
 // ChunkedWriter is an io.Writer wrapper that allows streaming by adding uvarint delimiter before each write in a form
 // of length of the corresponded byte array.
+//
+// By default frames are written bare, i.e. uvarint(len) || payload, exactly as before per-frame compression was
+// introduced. Constructing with NewChunkedWriterWithCodec additionally prefixes each payload with a 1-byte Codec tag
+// and compresses it accordingly; this must be paired with a ChunkedReader constructed with the matching
+// WithCodec constructor so it knows to expect the tag.
 type ChunkedWriter struct {
 	writer  io.Writer
 	flusher http.Flusher
+
+	withCodec bool
+	codec     Codec
 }
 
-// NewChunkedWriter constructs a ChunkedWriter.
+// NewChunkedWriter constructs a ChunkedWriter that writes bare, uncompressed frames.
 func NewChunkedWriter(w io.Writer, f http.Flusher) *ChunkedWriter {
 	return &ChunkedWriter{writer: w, flusher: f}
 }
 
+// NewChunkedWriterWithCodec constructs a ChunkedWriter that compresses every frame's payload with codec and
+// prefixes it with a 1-byte codec tag. The paired ChunkedReader must be constructed with a WithCodec constructor
+// to correctly parse the tag.
+func NewChunkedWriterWithCodec(w io.Writer, f http.Flusher, codec Codec) *ChunkedWriter {
+	return &ChunkedWriter{writer: w, flusher: f, withCodec: true, codec: codec}
+}
+
 // Write writes given bytes to the stream. It adds uvarint delimiter before each message.
 // Returned bytes number represents sent bytes for a given buffer. The number does not include delimiter bytes.
 // It does the flushing for you.
@@ -40,46 +88,464 @@ func (w *ChunkedWriter) Write(b []byte) (int, error) {
 		return 0, nil
 	}
 
+	frame := b
+	if w.withCodec {
+		payload, err := encodeCodec(w.codec, b)
+		if err != nil {
+			return 0, err
+		}
+		frame = append([]byte{byte(w.codec)}, payload...)
+	}
+
 	var buf [binary.MaxVarintLen64]byte
-	v := binary.PutUvarint(buf[:], uint64(len(b)))
+	v := binary.PutUvarint(buf[:], uint64(len(frame)))
 
 	if _, err := w.writer.Write(buf[:v]); err != nil {
 		return 0, err
 	}
 
-	n, err := w.writer.Write(b)
+	n, err := w.writer.Write(frame)
 	if err != nil {
 		return n, err
 	}
 
 	w.flusher.Flush()
+	if w.withCodec {
+		// n counts compressed+tag bytes written; report the original payload size instead,
+		// matching the bare-frame contract that n reflects len(b).
+		n = len(b)
+	}
 	return n, nil
 }
 
+// encodeCodec compresses b according to codec, returning b unchanged for CodecNone.
+func encodeCodec(codec Codec, b []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return b, nil
+	case CodecSnappy:
+		return snappy.Encode(nil, b), nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(b); err != nil {
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("chunked write: unknown codec %d", codec)
+	}
+}
+
+// decodeCodec decompresses b according to codec, returning b unchanged for CodecNone. maxFrame bounds the
+// decompressed size, the same limit NextRaw enforces on the wire size: without it, a small compressed frame could
+// decompress to an arbitrarily large buffer (a decompression bomb), defeating ErrFrameTooLarge entirely.
+func decodeCodec(codec Codec, b []byte, maxFrame uint64) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return b, nil
+	case CodecSnappy:
+		n, err := snappy.DecodedLen(b)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || uint64(n) > maxFrame {
+			return nil, ErrFrameTooLarge
+		}
+		return snappy.Decode(nil, b)
+	case CodecGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(gr, int64(maxFrame)+1))
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(data)) > maxFrame {
+			return nil, ErrFrameTooLarge
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("chunked read: unknown codec %d", codec)
+	}
+}
+
+// errBufferedChunkedWriterClosed is returned by BufferedChunkedWriter.Write once the writer has been closed.
+var errBufferedChunkedWriterClosed = errors.New("chunked write: writer is closed")
+
+// BufferedChunkedWriter is an io.Writer wrapper like ChunkedWriter, except it coalesces the uvarint-delimited
+// frames of several Write calls into a single underlying write and flush, rather than flushing after every frame.
+// This amortizes the cost of a flush (a TCP write, or a DATA frame under HTTP/2) across many small frames, at the
+// cost of buffering writes for up to flushInterval before a reader sees them.
+type BufferedChunkedWriter struct {
+	writer        io.Writer
+	flusher       http.Flusher
+	flushBytes    int
+	flushInterval time.Duration
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	timer  *time.Timer
+	closed bool
+	err    error // sticky: once a flush to writer fails, every call returns this until Close.
+}
+
+// NewBufferedChunkedWriter constructs a BufferedChunkedWriter that flushes buffered frames to w once their
+// encoded size reaches flushBytes, or flushInterval has elapsed since the last flush, whichever comes first. The
+// interval timer is started lazily on the first Write and stopped by Close.
+func NewBufferedChunkedWriter(w io.Writer, f http.Flusher, flushBytes int, flushInterval time.Duration) *BufferedChunkedWriter {
+	return &BufferedChunkedWriter{writer: w, flusher: f, flushBytes: flushBytes, flushInterval: flushInterval}
+}
+
+// Write buffers given bytes as a uvarint length-delimited frame, the same wire format as ChunkedWriter.Write, and
+// flushes once the buffer reaches flushBytes. Returned bytes number represents the buffered payload size; it does
+// not include delimiter bytes. Unlike ChunkedWriter, Write does not flush on every call: call Flush for an
+// explicit barrier (e.g. an end-of-query marker) if the reader must observe a frame immediately.
+func (w *BufferedChunkedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, errBufferedChunkedWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.timer == nil && w.flushInterval > 0 {
+		w.timer = time.AfterFunc(w.flushInterval, w.onTimer)
+	}
+
+	var lbuf [binary.MaxVarintLen64]byte
+	v := binary.PutUvarint(lbuf[:], uint64(len(b)))
+	w.buf.Write(lbuf[:v])
+	w.buf.Write(b)
+
+	if w.flushBytes > 0 && w.buf.Len() >= w.flushBytes {
+		if err := w.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes any buffered frames to the underlying writer and flushes it, even if neither flushBytes nor
+// flushInterval has been reached yet.
+func (w *BufferedChunkedWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked()
+}
+
+// Close stops the interval timer and flushes any residual buffered frames. It is safe to call Close more than
+// once.
+func (w *BufferedChunkedWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	return w.flushLocked()
+}
+
+// onTimer is run by the interval timer; it flushes whatever is buffered and, unless the writer has since been
+// closed or flushLocked has hit a sticky error, reschedules itself for the next interval.
+func (w *BufferedChunkedWriter) onTimer() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || w.flushLocked() != nil {
+		return
+	}
+	w.timer.Reset(w.flushInterval)
+}
+
+// flushLocked writes out the buffer, discarding only the prefix the underlying writer actually accepted so a
+// partial write is not resent on the next flush. Once writer.Write fails, the error becomes sticky: every
+// subsequent call on w returns it until Close, since the buffer can no longer be written to a known-good offset.
+// w.mu must be held.
+func (w *BufferedChunkedWriter) flushLocked() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	n, err := w.writer.Write(w.buf.Bytes())
+	w.buf.Next(n)
+	if err != nil {
+		w.err = err
+		return err
+	}
+
+	w.buf.Reset()
+	w.flusher.Flush()
+	return nil
+}
+
 // ChunkedReader is a buffered reader that expects uvarint delimiter before each message.
-// It will allocate as much as the biggest frame defined by delimiter (on top of bufio.Reader allocations).
+// It will allocate as much as the biggest frame defined by delimiter (on top of bufio.Reader allocations),
+// but not more than maxFrame.
 type ChunkedReader struct {
-	b    *bufio.Reader
-	data []byte
+	b        *bufio.Reader
+	raw      []byte
+	data     []byte
+	maxFrame uint64
+
+	withCodec bool
+	lastCodec Codec
 }
 
-// NewChunkedReader constructs a ChunkedReader.
+// NewChunkedReader constructs a ChunkedReader with DefaultChunkedReadLimit as the maximum frame size, expecting
+// bare frames with no codec tag.
 func NewChunkedReader(r io.Reader) *ChunkedReader {
-	return &ChunkedReader{b: bufio.NewReader(r)}
+	return NewChunkedReaderSize(r, DefaultChunkedReadLimit)
+}
+
+// NewChunkedReaderSize constructs a ChunkedReader rejecting any frame larger than maxFrame bytes, expecting bare
+// frames with no codec tag.
+func NewChunkedReaderSize(r io.Reader, maxFrame uint64) *ChunkedReader {
+	return &ChunkedReader{b: bufio.NewReader(r), maxFrame: maxFrame}
+}
+
+// NewChunkedReaderSizeWithCodec constructs a ChunkedReader that expects every frame to carry a leading 1-byte
+// Codec tag, as written by a ChunkedWriter constructed with NewChunkedWriterWithCodec. This is the handshake flag
+// referred to by Next/NextProto: it must be negotiated out-of-band (e.g. via content-type) between writer and
+// reader, since a bare frame and a codec-tagged frame are indistinguishable on the wire otherwise.
+func NewChunkedReaderSizeWithCodec(r io.Reader, maxFrame uint64) *ChunkedReader {
+	return &ChunkedReader{b: bufio.NewReader(r), maxFrame: maxFrame, withCodec: true}
 }
 
 // Next returns the next length-delimited record from the input, or io.EOF if
 // there are no more records available. Returns io.ErrUnexpectedEOF if a short
-// record is found, with a length of n but fewer than n bytes of data.
+// record is found, with a length of n but fewer than n bytes of data. Returns
+// ErrFrameTooLarge if the declared length of a record exceeds the reader's
+// maxFrame without reading the (potentially malicious) payload.
+//
+// If the reader was constructed WithCodec, the frame's codec tag is consumed and the payload is decompressed
+// before being returned; use LastCodec to inspect which codec was used, or NextRaw to defer decompression.
 //
 // NOTE: The slice returned is valid only until a subsequent call to Next. It's a caller's responsibility to copy the
-// returned slice if needed.
+// returned slice if needed, or to use NextAppend instead.
 func (r *ChunkedReader) Next() ([]byte, error) {
+	raw, err := r.NextRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.withCodec {
+		return raw, nil
+	}
+
+	data, err := decodeCodec(r.lastCodec, raw, r.maxFrame)
+	if err != nil {
+		return nil, err
+	}
+	r.data = data
+	return r.data, nil
+}
+
+// NextRaw returns the next frame exactly as it appears on the wire, without decompressing it: if the reader was
+// constructed WithCodec, the leading codec tag is stripped and recorded (retrievable via LastCodec) but the
+// payload itself is left compressed, letting callers defer or skip decompression.
+//
+// NOTE: The slice returned is valid only until a subsequent call to Next or NextRaw.
+func (r *ChunkedReader) NextRaw() ([]byte, error) {
 	size, err := binary.ReadUvarint(r.b)
 	if err != nil {
 		return nil, err
 	}
 
+	if size > r.maxFrame || size > uint64(^uint(0)>>1) {
+		return nil, ErrFrameTooLarge
+	}
+
+	if cap(r.raw) < int(size) {
+		r.raw = make([]byte, size)
+	} else {
+		r.raw = r.raw[:size]
+	}
+
+	if _, err := io.ReadFull(r.b, r.raw); err != nil {
+		return nil, err
+	}
+
+	if !r.withCodec {
+		return r.raw, nil
+	}
+
+	if len(r.raw) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r.lastCodec = Codec(r.raw[0])
+	return r.raw[1:], nil
+}
+
+// LastCodec returns the codec tag read by the most recent call to Next or NextRaw. It is only meaningful for
+// readers constructed WithCodec.
+func (r *ChunkedReader) LastCodec() Codec {
+	return r.lastCodec
+}
+
+// NextProto consumes the next available record by calling r.Next, and decodes
+// it into the protobuf with proto.Unmarshal.
+func (r *ChunkedReader) NextProto(pb proto.Message) error {
+	rec, err := r.Next()
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(rec, pb)
+}
+
+// NextProtoReset behaves like NextProto, but calls pb.Reset() before unmarshalling so that decoder state (e.g.
+// repeated fields) left over from a previous frame cannot leak into this one. Use this instead of NextProto when
+// reusing the same proto.Message across frames in a zero-allocation hot loop.
+func (r *ChunkedReader) NextProtoReset(pb proto.Message) error {
+	pb.Reset()
+	return r.NextProto(pb)
+}
+
+// NextAppend reads the next frame into dst, growing it with append as needed, and returns the resulting slice.
+// Unlike Next, the returned slice is owned by the caller: it is never reused or overwritten by a subsequent call
+// to Next, NextRaw or NextAppend, so callers are free to retain it across iterations or draw dst from a pool.
+//
+// If the reader was constructed WithCodec, the payload is decompressed into dst; decompression cannot avoid an
+// intermediate allocation for the compressed bytes, which Next/NextRaw's internal buffer is reused for.
+func (r *ChunkedReader) NextAppend(dst []byte) ([]byte, error) {
+	raw, err := r.NextRaw()
+	if err != nil {
+		return dst, err
+	}
+
+	if !r.withCodec {
+		return append(dst, raw...), nil
+	}
+
+	data, err := decodeCodec(r.lastCodec, raw, r.maxFrame)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, data...), nil
+}
+
+// maxChunkHeaderLineLength mirrors net/http/internal's maxLineLength: chunk-size
+// lines (and any trailing chunk-extension) longer than this are rejected rather
+// than read unbounded into memory.
+const maxChunkHeaderLineLength = 4096
+
+// HTTPChunkedWriter is an io.Writer wrapper that frames each write as one RFC
+// 7230 HTTP chunk (`hex(len) CRLF payload CRLF`), the same wire format used by
+// net/http/internal for "Transfer-Encoding: chunked". Unlike ChunkedWriter's
+// uvarint framing, this format can be relayed unmodified by any HTTP-aware
+// proxy or load balancer that does not know about Prometheus's custom framing.
+type HTTPChunkedWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+}
+
+// NewHTTPChunkedWriter constructs an HTTPChunkedWriter.
+func NewHTTPChunkedWriter(w io.Writer, f http.Flusher) *HTTPChunkedWriter {
+	return &HTTPChunkedWriter{writer: w, flusher: f}
+}
+
+// Write writes given bytes to the stream as a single HTTP chunk. Returned
+// bytes number represents sent bytes for a given buffer; it does not include
+// the chunk-size line or trailing CRLF. It does the flushing for you.
+func (w *HTTPChunkedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if _, err := fmt.Fprintf(w.writer, "%x\r\n", len(b)); err != nil {
+		return 0, err
+	}
+
+	n, err := w.writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	if _, err := w.writer.Write(crlf); err != nil {
+		return n, err
+	}
+
+	w.flusher.Flush()
+	return n, nil
+}
+
+// Close writes the terminating zero-length chunk (`0 CRLF CRLF`), signalling
+// the end of the stream to the reader.
+func (w *HTTPChunkedWriter) Close() error {
+	_, err := w.writer.Write(lastChunk)
+	return err
+}
+
+var (
+	crlf      = []byte("\r\n")
+	lastChunk = []byte("0\r\n\r\n")
+)
+
+// HTTPChunkedReader is a buffered reader that parses RFC 7230 HTTP chunked
+// Transfer-Encoding framing, as written by HTTPChunkedWriter.
+type HTTPChunkedReader struct {
+	b        *bufio.Reader
+	data     []byte
+	maxFrame uint64
+}
+
+// NewHTTPChunkedReader constructs an HTTPChunkedReader with DefaultChunkedReadLimit as the maximum chunk size.
+func NewHTTPChunkedReader(r io.Reader) *HTTPChunkedReader {
+	return NewHTTPChunkedReaderSize(r, DefaultChunkedReadLimit)
+}
+
+// NewHTTPChunkedReaderSize constructs an HTTPChunkedReader rejecting any chunk larger than maxFrame bytes, the
+// same protection ChunkedReader gets from NewChunkedReaderSize: a peer declaring an oversized chunk-size line
+// fails immediately instead of forcing a make([]byte, size) allocation for an attacker-controlled size.
+func NewHTTPChunkedReaderSize(r io.Reader, maxFrame uint64) *HTTPChunkedReader {
+	return &HTTPChunkedReader{b: bufio.NewReader(r), maxFrame: maxFrame}
+}
+
+// Next returns the next chunk from the input, or io.EOF once the terminating
+// zero-length chunk has been consumed. Chunk-extensions (anything after the
+// size on the chunk-size line) are tolerated and discarded. Returns
+// ErrFrameTooLarge if the declared chunk size exceeds the reader's maxFrame,
+// without reading the (potentially malicious) payload.
+//
+// NOTE: The slice returned is valid only until a subsequent call to Next. It's a caller's responsibility to copy the
+// returned slice if needed.
+func (r *HTTPChunkedReader) Next() ([]byte, error) {
+	size, err := r.readChunkSize()
+	if err != nil {
+		return nil, err
+	}
+
+	if size > r.maxFrame || size > uint64(^uint(0)>>1) {
+		return nil, ErrFrameTooLarge
+	}
+
+	if size == 0 {
+		// Final chunk: "0 CRLF CRLF".
+		if err := r.discardCRLF(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
 	if cap(r.data) < int(size) {
 		r.data = make([]byte, size)
 	} else {
@@ -89,15 +555,71 @@ func (r *ChunkedReader) Next() ([]byte, error) {
 	if _, err := io.ReadFull(r.b, r.data); err != nil {
 		return nil, err
 	}
+	if err := r.discardCRLF(); err != nil {
+		return nil, err
+	}
 	return r.data, nil
 }
 
-// NextProto consumes the next available record by calling r.Next, and decodes
+// NextProto consumes the next available chunk by calling r.Next, and decodes
 // it into the protobuf with proto.Unmarshal.
-func (r *ChunkedReader) NextProto(pb proto.Message) error {
+func (r *HTTPChunkedReader) NextProto(pb proto.Message) error {
 	rec, err := r.Next()
 	if err != nil {
 		return err
 	}
 	return proto.Unmarshal(rec, pb)
 }
+
+// readChunkSize reads a chunk-size line (hex size, optionally followed by
+// chunk-extensions, terminated by CRLF) and returns the parsed size.
+func (r *HTTPChunkedReader) readChunkSize() (uint64, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		// Strip chunk-extensions; we don't support any.
+		line = line[:i]
+	}
+	line = bytes.TrimSpace(line)
+
+	size, err := strconv.ParseUint(string(line), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("chunked read: invalid chunk size line %q: %w", line, err)
+	}
+	return size, nil
+}
+
+// readLine reads a single CRLF-terminated line, excluding the CRLF, capping
+// its length at maxChunkHeaderLineLength to bound memory use for malformed
+// input.
+func (r *HTTPChunkedReader) readLine() ([]byte, error) {
+	line, err := r.b.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull || len(line) > maxChunkHeaderLineLength {
+			return nil, fmt.Errorf("chunked read: chunk header line exceeds %d bytes", maxChunkHeaderLineLength)
+		}
+		return nil, err
+	}
+	if len(line) > maxChunkHeaderLineLength {
+		return nil, fmt.Errorf("chunked read: chunk header line exceeds %d bytes", maxChunkHeaderLineLength)
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("chunked read: malformed chunk header line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// discardCRLF reads and validates the CRLF that follows a chunk's payload.
+func (r *HTTPChunkedReader) discardCRLF() error {
+	var buf [2]byte
+	if _, err := io.ReadFull(r.b, buf[:]); err != nil {
+		return err
+	}
+	if buf[0] != '\r' || buf[1] != '\n' {
+		return fmt.Errorf("chunked read: malformed trailing CRLF")
+	}
+	return nil
+}
@@ -0,0 +1,447 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package remote
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// typicalTSDBChunkPayload returns a payload shaped roughly like a batch of TSDB sample chunks: a lot of small,
+// fairly repetitive float64/varint runs, which is what makes Snappy worthwhile on real remote-read responses.
+func typicalTSDBChunkPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 37)
+	}
+	return b
+}
+
+// nopFlusher is an http.Flusher that does nothing, for tests writing to a plain bytes.Buffer.
+type nopFlusher struct{}
+
+func (nopFlusher) Flush() {}
+
+func TestChunkedReader_Next(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewChunkedWriter(&buf, nopFlusher{})
+	if _, err := w.Write([]byte("frame one")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("frame two")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewChunkedReader(&buf)
+	for _, want := range []string{"frame one", "frame two"} {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("Next() = %q, want %q", got, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Next() after last frame = %v, want io.EOF", err)
+	}
+}
+
+func TestChunkedReader_FrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	var lbuf [binary.MaxVarintLen64]byte
+	v := binary.PutUvarint(lbuf[:], 1<<62) // declared length only, no payload follows.
+	buf.Write(lbuf[:v])
+
+	r := NewChunkedReaderSize(&buf, DefaultChunkedReadLimit)
+	if _, err := r.Next(); err != ErrFrameTooLarge {
+		t.Fatalf("Next() = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestChunkedReader_MaxFrameBoundary(t *testing.T) {
+	const maxFrame = 16
+
+	atLimit := bytes.Repeat([]byte("a"), maxFrame)
+	var buf bytes.Buffer
+	w := NewChunkedWriter(&buf, nopFlusher{})
+	if _, err := w.Write(atLimit); err != nil {
+		t.Fatal(err)
+	}
+	r := NewChunkedReaderSize(&buf, maxFrame)
+	if got, err := r.Next(); err != nil || !bytes.Equal(got, atLimit) {
+		t.Fatalf("Next() at exactly maxFrame = %q, %v, want %q, nil", got, err, atLimit)
+	}
+
+	overLimit := bytes.Repeat([]byte("a"), maxFrame+1)
+	buf.Reset()
+	if _, err := w.Write(overLimit); err != nil {
+		t.Fatal(err)
+	}
+	r = NewChunkedReaderSize(&buf, maxFrame)
+	if _, err := r.Next(); err != ErrFrameTooLarge {
+		t.Fatalf("Next() one byte over maxFrame = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestChunkedReader_Codec(t *testing.T) {
+	payload := typicalTSDBChunkPayload(4096)
+
+	for _, codec := range []Codec{CodecNone, CodecSnappy, CodecGzip} {
+		var buf bytes.Buffer
+		w := NewChunkedWriterWithCodec(&buf, nopFlusher{}, codec)
+		if _, err := w.Write(payload); err != nil {
+			t.Fatalf("codec %d: Write: %v", codec, err)
+		}
+
+		r := NewChunkedReaderSizeWithCodec(&buf, DefaultChunkedReadLimit)
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("codec %d: Next: %v", codec, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("codec %d: Next() round-trip mismatch", codec)
+		}
+		if r.LastCodec() != codec {
+			t.Fatalf("codec %d: LastCodec() = %d", codec, r.LastCodec())
+		}
+	}
+}
+
+func TestChunkedReader_CodecDecompressionBomb(t *testing.T) {
+	const maxFrame = 1024
+	// Highly compressible payload: its encoded frame fits well within maxFrame, but the decompressed
+	// payload does not, which is exactly the decompression-bomb case ErrFrameTooLarge must still catch.
+	// gzip is used because it reliably compresses runs of zeros by orders of magnitude; Snappy block
+	// compression is exercised by the DecodedLen pre-check directly below.
+	payload := bytes.Repeat([]byte{0}, 10*maxFrame)
+
+	var buf bytes.Buffer
+	w := NewChunkedWriterWithCodec(&buf, nopFlusher{}, CodecGzip)
+	if _, err := w.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= maxFrame {
+		t.Fatalf("encoded frame is %d bytes, test no longer exercises the bomb case", buf.Len())
+	}
+
+	r := NewChunkedReaderSizeWithCodec(&buf, maxFrame)
+	if _, err := r.Next(); err != ErrFrameTooLarge {
+		t.Fatalf("Next() = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestDecodeCodec_SnappyDecodedLenTooLarge(t *testing.T) {
+	// decodeCodec must reject an oversized Snappy frame using the length embedded in its header, without
+	// ever calling snappy.Decode (and thus without needing to allocate the oversized output).
+	big := bytes.Repeat([]byte{0}, 10*1024)
+	encoded, err := encodeCodec(CodecSnappy, big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeCodec(CodecSnappy, encoded, 1024); err != ErrFrameTooLarge {
+		t.Fatalf("decodeCodec() = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestChunkedReader_NextAppendOwnership(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewChunkedWriter(&buf, nopFlusher{})
+	if _, err := w.Write([]byte("frame one")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("frame two")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewChunkedReader(&buf)
+	first, err := r.NextAppend(nil)
+	if err != nil {
+		t.Fatalf("NextAppend: %v", err)
+	}
+	firstWant := append([]byte(nil), first...)
+
+	// Unlike Next, a second call must not alias or overwrite the first call's result.
+	second, err := r.NextAppend(nil)
+	if err != nil {
+		t.Fatalf("NextAppend: %v", err)
+	}
+
+	if !bytes.Equal(first, firstWant) {
+		t.Fatalf("first NextAppend result changed after a second call: got %q, want %q", first, firstWant)
+	}
+	if string(first) != "frame one" || string(second) != "frame two" {
+		t.Fatalf("NextAppend() = %q, %q, want %q, %q", first, second, "frame one", "frame two")
+	}
+}
+
+// resetTrackingMessage is a minimal proto.Message that records whether Reset was called and simulates a repeated
+// field by accumulating across Unmarshal calls: without an intervening Reset, stale data from a previous frame
+// would leak into the next one, exactly as with a real repeated protobuf field.
+type resetTrackingMessage struct {
+	resets int
+	data   string
+}
+
+func (m *resetTrackingMessage) Reset() {
+	m.resets++
+	m.data = ""
+}
+func (m *resetTrackingMessage) String() string { return m.data }
+func (m *resetTrackingMessage) ProtoMessage()  {}
+func (m *resetTrackingMessage) Unmarshal(b []byte) error {
+	m.data += string(b)
+	return nil
+}
+
+func TestChunkedReader_NextProtoReset(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewChunkedWriter(&buf, nopFlusher{})
+	if _, err := w.Write([]byte("aaa")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("bbb")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewChunkedReader(&buf)
+	msg := &resetTrackingMessage{}
+
+	if err := r.NextProtoReset(msg); err != nil {
+		t.Fatalf("NextProtoReset: %v", err)
+	}
+	if msg.data != "aaa" {
+		t.Fatalf("after first frame, data = %q, want %q", msg.data, "aaa")
+	}
+
+	if err := r.NextProtoReset(msg); err != nil {
+		t.Fatalf("NextProtoReset: %v", err)
+	}
+	if msg.data != "bbb" {
+		t.Fatalf("after second frame, data = %q, want %q (stale data from the first frame leaked)", msg.data, "bbb")
+	}
+	if msg.resets != 2 {
+		t.Fatalf("resets = %d, want 2", msg.resets)
+	}
+}
+
+func benchmarkChunkedWriteRead(b *testing.B, codec Codec) {
+	payload := typicalTSDBChunkPayload(8192)
+	var buf bytes.Buffer
+	var w *ChunkedWriter
+	var r *ChunkedReader
+	if codec == CodecNone {
+		w = NewChunkedWriter(&buf, nopFlusher{})
+		r = NewChunkedReader(&buf)
+	} else {
+		w = NewChunkedWriterWithCodec(&buf, nopFlusher{}, codec)
+		r = NewChunkedReaderSizeWithCodec(&buf, DefaultChunkedReadLimit)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := r.Next(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkChunkedWriteRead_Unframed measures the existing bare uvarint|payload framing, with no compression, as
+// the baseline for BenchmarkChunkedWriteRead_Snappy.
+func BenchmarkChunkedWriteRead_Unframed(b *testing.B) {
+	benchmarkChunkedWriteRead(b, CodecNone)
+}
+
+// BenchmarkChunkedWriteRead_Snappy measures per-frame Snappy compression against typical TSDB chunk payloads.
+func BenchmarkChunkedWriteRead_Snappy(b *testing.B) {
+	benchmarkChunkedWriteRead(b, CodecSnappy)
+}
+
+func TestHTTPChunkedReader_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewHTTPChunkedWriter(&buf, nopFlusher{})
+	if _, err := w.Write([]byte("frame one")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("frame two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewHTTPChunkedReader(&buf)
+	for _, want := range []string{"frame one", "frame two"} {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("Next() = %q, want %q", got, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Next() after last chunk = %v, want io.EOF", err)
+	}
+}
+
+func TestHTTPChunkedReader_FrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("ffffffff\r\n") // declared length only, no payload follows.
+
+	r := NewHTTPChunkedReaderSize(&buf, DefaultChunkedReadLimit)
+	if _, err := r.Next(); err != ErrFrameTooLarge {
+		t.Fatalf("Next() = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestHTTPChunkedReader_InvalidHex(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("not-hex\r\n")
+
+	r := NewHTTPChunkedReader(&buf)
+	if _, err := r.Next(); err == nil {
+		t.Fatal("Next() = nil error, want an error for an invalid hex chunk-size line")
+	}
+}
+
+func TestHTTPChunkedReader_LineTooLong(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(strings.Repeat("a", maxChunkHeaderLineLength+1))
+	buf.WriteString("\r\n")
+
+	r := NewHTTPChunkedReader(&buf)
+	if _, err := r.Next(); err == nil {
+		t.Fatal("Next() = nil error, want an error for a chunk header line exceeding the 4 KiB cap")
+	}
+}
+
+func TestHTTPChunkedReader_ChunkExtension(t *testing.T) {
+	const payload = "frame"
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%x;ext=ignored\r\n", len(payload))
+	buf.WriteString(payload)
+	buf.WriteString("\r\n")
+	buf.WriteString("0\r\n\r\n")
+
+	r := NewHTTPChunkedReader(&buf)
+	got, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if string(got) != payload {
+		t.Fatalf("Next() = %q, want %q", got, payload)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Next() after last chunk = %v, want io.EOF", err)
+	}
+}
+
+// countingWriter counts how many times the underlying Write is called, standing in for the number of syscalls
+// (or, under HTTP/2, DATA frames) a real io.Writer would incur.
+type countingWriter struct {
+	io.Writer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Writer.Write(p)
+}
+
+func TestBufferedChunkedWriter_Coalesces(t *testing.T) {
+	var buf bytes.Buffer
+	cw := &countingWriter{Writer: &buf}
+
+	const frames = 5
+	w := NewBufferedChunkedWriter(cw, nopFlusher{}, 1<<20, 0) // large flushBytes, no interval: only Flush/Close write.
+	for i := 0; i < frames; i++ {
+		if _, err := w.Write([]byte("frame")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cw.writes != 0 {
+		t.Fatalf("writes before Flush = %d, want 0", cw.writes)
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if cw.writes != 1 {
+		t.Fatalf("writes after Flush = %d, want 1 (all %d frames coalesced into one write)", cw.writes, frames)
+	}
+
+	if _, err := w.Write([]byte("residual")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if cw.writes != 2 {
+		t.Fatalf("writes after Close = %d, want 2 (Close flushed the residual frame)", cw.writes)
+	}
+
+	r := NewChunkedReader(&buf)
+	for i := 0; i < frames; i++ {
+		if got, err := r.Next(); err != nil || string(got) != "frame" {
+			t.Fatalf("Next() = %q, %v, want \"frame\", nil", got, err)
+		}
+	}
+	if got, err := r.Next(); err != nil || string(got) != "residual" {
+		t.Fatalf("Next() = %q, %v, want \"residual\", nil", got, err)
+	}
+}
+
+func benchmarkWriteSmallFrames(b *testing.B, newWriter func(w io.Writer) interface{ Write([]byte) (int, error) }) {
+	const frameSize = 512
+	payload := typicalTSDBChunkPayload(frameSize)
+	cw := &countingWriter{Writer: ioutil.Discard}
+	w := newWriter(cw)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(frameSize))
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if closer, ok := w.(interface{ Close() error }); ok {
+		closer.Close()
+	}
+	b.ReportMetric(float64(cw.writes)/float64(b.N), "writes/op")
+}
+
+// BenchmarkWriteSmallFrames_ChunkedWriter flushes (and thus writes to the underlying io.Writer) on every frame,
+// the baseline for BenchmarkWriteSmallFrames_BufferedChunkedWriter.
+func BenchmarkWriteSmallFrames_ChunkedWriter(b *testing.B) {
+	benchmarkWriteSmallFrames(b, func(w io.Writer) interface{ Write([]byte) (int, error) } {
+		return NewChunkedWriter(w, nopFlusher{})
+	})
+}
+
+// BenchmarkWriteSmallFrames_BufferedChunkedWriter demonstrates the reduced underlying-write count from coalescing
+// many sub-1KiB frames, per chunk0-5.
+func BenchmarkWriteSmallFrames_BufferedChunkedWriter(b *testing.B) {
+	benchmarkWriteSmallFrames(b, func(w io.Writer) interface{ Write([]byte) (int, error) } {
+		return NewBufferedChunkedWriter(w, nopFlusher{}, 64*1024, 0)
+	})
+}